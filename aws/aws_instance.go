@@ -0,0 +1,82 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nanovms/ops/lepton"
+)
+
+// selectSubnetForInstance resolves the subnet an instance should be launched into. It starts from the subnets
+// GetSubnet matches for vpcID, classifies them public/private via isPublicSubnet, and prefers a public subnet
+// (so the instance gets a routable address) unless the caller explicitly asked for a private one.
+func (p *AWS) selectSubnetForInstance(ctx *lepton.Context, svc *ec2.EC2, vpcID string, wantPrivate bool, index int) (*ec2.Subnet, error) {
+	subnets, err := p.GetSubnet(ctx, svc, vpcID)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*ec2.Subnet
+
+	for _, subnet := range subnets {
+		isPublic, err := p.isPublicSubnet(svc, subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		if isPublic != wantPrivate {
+			candidates = append(candidates, subnet)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = subnets
+	}
+
+	subnet, err := pickSubnet(candidates, ctx.Config().CloudConfig.AvailabilityZone, index)
+	if err != nil {
+		return nil, err
+	}
+
+	az, err := getAzFromSubnetId(svc, *subnet.SubnetId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Logger().Debug("picked subnet %s in availability zone %s", *subnet.SubnetId, az)
+
+	return subnet, nil
+}
+
+// ensureVPC returns the VPC instances should be created in, creating one (tagged with kubernetes.io/role/* subnet
+// role tags for downstream ELB provisioning) if none exists yet.
+func (p *AWS) ensureVPC(ctx *lepton.Context, svc *ec2.EC2) (*ec2.Vpc, []*ec2.Subnet, error) {
+	vpc, err := p.GetVPC(ctx, svc)
+	if err == nil && vpc != nil {
+		return vpc, nil, nil
+	}
+
+	return p.CreateVPC(ctx, svc, true)
+}
+
+// describeVPCSubnetsByAZ groups every subnet in vpcID by availability zone, using ListVPCSubnets, so callers can
+// see at a glance how many AZs a VPC spans before picking one with getAzFromSubnetId.
+func (p *AWS) describeVPCSubnetsByAZ(svc *ec2.EC2, vpcID string) (map[string][]*ec2.Subnet, error) {
+	subnets, err := p.ListVPCSubnets(svc, vpcID)
+	if err != nil {
+		return nil, err
+	}
+
+	byAZ := map[string][]*ec2.Subnet{}
+
+	for _, subnet := range subnets {
+		az, err := getAzFromSubnetId(svc, *subnet.SubnetId)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve availability zone for subnet '%s': %v", *subnet.SubnetId, err)
+		}
+
+		byAZ[az] = append(byAZ[az], subnet)
+	}
+
+	return byAZ, nil
+}
@@ -1,12 +1,16 @@
 package aws
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -16,9 +20,21 @@ import (
 	"github.com/nanovms/ops/types"
 )
 
-// GetSecurityGroup checks whether the configuration security group exists and has the configuration VPC assigned
+// GetSecurityGroup checks whether the configuration security group exists and has the configuration VPC assigned.
+// When ControlPlaneSecurityGroupID or WorkerSecurityGroupID is set in CloudConfig, the referenced security group is
+// adopted as-is instead of being looked up by name, and is left untouched (no tagging/mutation).
 func (p *AWS) GetSecurityGroup(ctx *lepton.Context, svc *ec2.EC2, vpc *ec2.Vpc) (sg *ec2.SecurityGroup, err error) {
-	sgName := ctx.Config().CloudConfig.SecurityGroup
+	cloudConfig := ctx.Config().CloudConfig
+
+	if sgID := cloudConfig.ControlPlaneSecurityGroupID; sgID != "" {
+		return p.adoptSecurityGroup(svc, vpc, sgID)
+	}
+
+	if sgID := cloudConfig.WorkerSecurityGroupID; sgID != "" {
+		return p.adoptSecurityGroup(svc, vpc, sgID)
+	}
+
+	sgName := cloudConfig.SecurityGroup
 
 	input := &ec2.DescribeSecurityGroupsInput{
 		Filters: []*ec2.Filter{
@@ -61,15 +77,49 @@ func (p *AWS) GetSecurityGroup(ctx *lepton.Context, svc *ec2.EC2, vpc *ec2.Vpc)
 	return
 }
 
-// GetSubnet returns a subnet with the context subnet name or the default subnet of vpc passed by argument
-func (p *AWS) GetSubnet(ctx *lepton.Context, svc *ec2.EC2, vpcID string) (*ec2.Subnet, error) {
+// adoptSecurityGroup resolves a user-supplied security group ID, validating that it belongs to vpc, without
+// tagging or otherwise mutating it.
+func (p *AWS) adoptSecurityGroup(svc *ec2.EC2, vpc *ec2.Vpc, sgID string) (sg *ec2.SecurityGroup, err error) {
+	result, err := svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice([]string{sgID}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get security group with id '%s': %s", sgID, err.Error())
+	} else if len(result.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("security group '%s' not found", sgID)
+	}
+
+	sg = result.SecurityGroups[0]
+
+	if *sg.VpcId != *vpc.VpcId {
+		return nil, fmt.Errorf("vpc mismatch: expected '%s' to have vpc '%s', got '%s'", sgID, *vpc.VpcId, *sg.VpcId)
+	}
+
+	return sg, nil
+}
+
+// GetSubnet returns the subnets matching the context subnet name (or every subnet of vpcID if no name is set),
+// optionally pinned to CloudConfig.AvailabilityZone. When CloudConfig.SubnetIDs is set, those subnets are adopted
+// as-is after validating they belong to vpcID, without any further name-based lookup. Callers that need a single
+// subnet (e.g. to associate a security group with) should use the first entry, which is the default-for-AZ subnet
+// whenever one is present among the matches.
+func (p *AWS) GetSubnet(ctx *lepton.Context, svc *ec2.EC2, vpcID string) ([]*ec2.Subnet, error) {
+	if subnetIDs := ctx.Config().CloudConfig.SubnetIDs; len(subnetIDs) != 0 {
+		return p.adoptSubnets(svc, vpcID, subnetIDs)
+	}
+
 	subnetName := ctx.Config().CloudConfig.Subnet
+	az := ctx.Config().CloudConfig.AvailabilityZone
 	var filters []*ec2.Filter
 	var result *ec2.DescribeSubnetsOutput
 	var err error
 
 	filters = append(filters, &ec2.Filter{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{vpcID})})
 
+	if az != "" {
+		filters = append(filters, &ec2.Filter{Name: aws.String("availability-zone"), Values: aws.StringSlice([]string{az})})
+	}
+
 	if subnetName != "" {
 		result, err = svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
 			Filters: append(filters, &ec2.Filter{Name: aws.String("tag:Name"), Values: aws.StringSlice([]string{subnetName})}),
@@ -100,23 +150,153 @@ func (p *AWS) GetSubnet(ctx *lepton.Context, svc *ec2.EC2, vpcID string) (*ec2.S
 
 	if len(result.Subnets) == 0 && subnetName != "" {
 		return nil, fmt.Errorf("no subnets with name '%v' found to associate security group with", subnetName)
+	} else if len(result.Subnets) == 0 && az != "" {
+		return nil, fmt.Errorf("no subnets found in availability zone '%v' to associate security group with", az)
 	} else if len(result.Subnets) == 0 {
 		return nil, errors.New("no subnets found to associate security group with")
 	}
 
-	if subnetName != "" {
-		for _, subnet := range result.Subnets {
-			if *subnet.DefaultForAz {
+	subnets := result.Subnets
+
+	for i, subnet := range subnets {
+		if *subnet.DefaultForAz && i != 0 {
+			subnets[0], subnets[i] = subnets[i], subnets[0]
+			break
+		}
+	}
+
+	return subnets, nil
+}
+
+// getAzFromSubnetId returns the availability zone a subnet belongs to.
+func getAzFromSubnetId(svc *ec2.EC2, subnetID string) (string, error) {
+	result, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice([]string{subnetID}),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to describe subnet '%s', %v", subnetID, err)
+	} else if len(result.Subnets) == 0 {
+		return "", fmt.Errorf("subnet '%s' not found", subnetID)
+	}
+
+	return *result.Subnets[0].AvailabilityZone, nil
+}
+
+// pickSubnet selects which of the subnets returned by GetSubnet an instance should land in: it honors an explicit
+// AZ preference first, falls back to the default-for-AZ subnet, and otherwise round-robins across the list using
+// index so successive calls spread instances across availability zones.
+func pickSubnet(subnets []*ec2.Subnet, az string, index int) (*ec2.Subnet, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("no subnets to pick from")
+	}
+
+	if az != "" {
+		for _, subnet := range subnets {
+			if *subnet.AvailabilityZone == az {
 				return subnet, nil
 			}
 		}
+
+		return nil, fmt.Errorf("no subnet found in availability zone '%s'", az)
 	}
 
-	return result.Subnets[0], nil
+	for _, subnet := range subnets {
+		if *subnet.DefaultForAz {
+			return subnet, nil
+		}
+	}
+
+	return subnets[index%len(subnets)], nil
 }
 
-// GetVPC returns a vpc with the context vpc name or the default vpc
+// adoptSubnets resolves a list of user-supplied subnet IDs, validating that each one belongs to vpcID, without
+// tagging or otherwise mutating them.
+func (p *AWS) adoptSubnets(svc *ec2.EC2, vpcID string, subnetIDs []string) ([]*ec2.Subnet, error) {
+	result, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(subnetIDs),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe subnets, %v", err)
+	}
+
+	if len(result.Subnets) != len(subnetIDs) {
+		return nil, fmt.Errorf("some of the subnets %v were not found", subnetIDs)
+	}
+
+	for _, subnet := range result.Subnets {
+		if *subnet.VpcId != vpcID {
+			return nil, fmt.Errorf("vpc mismatch: expected subnet '%s' to have vpc '%s', got '%s'", *subnet.SubnetId, vpcID, *subnet.VpcId)
+		}
+	}
+
+	return result.Subnets, nil
+}
+
+// ListVPCSubnets returns every subnet belonging to vpcID.
+func (p *AWS) ListVPCSubnets(svc *ec2.EC2, vpcID string) ([]*ec2.Subnet, error) {
+	result, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{vpcID})},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe subnets, %v", err)
+	}
+
+	return result.Subnets, nil
+}
+
+// isPublicSubnet classifies a subnet as public by checking whether the route table associated with it (or the
+// VPC's main route table, if none is explicitly associated) has a default route pointing at an internet gateway.
+func (p *AWS) isPublicSubnet(svc *ec2.EC2, subnet *ec2.Subnet) (bool, error) {
+	result, err := svc.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("association.subnet-id"), Values: aws.StringSlice([]string{*subnet.SubnetId})},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to describe route tables, %v", err)
+	}
+
+	if len(result.RouteTables) == 0 {
+		result, err = svc.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{*subnet.VpcId})},
+				{Name: aws.String("association.main"), Values: aws.StringSlice([]string{"true"})},
+			},
+		})
+		if err != nil {
+			return false, fmt.Errorf("unable to describe route tables, %v", err)
+		}
+	}
+
+	for _, rt := range result.RouteTables {
+		for _, route := range rt.Routes {
+			if route.DestinationCidrBlock != nil && *route.DestinationCidrBlock == "0.0.0.0/0" && route.GatewayId != nil && strings.HasPrefix(*route.GatewayId, "igw-") {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// GetVPC returns a vpc with the context vpc name or the default vpc. When CloudConfig.VPCID is set, that VPC is
+// adopted as-is after validating it exists, without any further name-based lookup.
 func (p *AWS) GetVPC(ctx *lepton.Context, svc *ec2.EC2) (*ec2.Vpc, error) {
+	if vpcID := ctx.Config().CloudConfig.VPCID; vpcID != "" {
+		result, err := svc.DescribeVpcs(&ec2.DescribeVpcsInput{
+			VpcIds: aws.StringSlice([]string{vpcID}),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe VPCs, %v", err)
+		} else if len(result.Vpcs) == 0 {
+			return nil, fmt.Errorf("vpc '%s' not found", vpcID)
+		}
+
+		return result.Vpcs[0], nil
+	}
+
 	vpcName := ctx.Config().CloudConfig.VPC
 
 	var vpc *ec2.Vpc
@@ -223,70 +403,471 @@ func (p AWS) buildFirewallRule(protocol string, port string) *ec2.IpPermission {
 	return ec2Permission
 }
 
-// CreateSG - Create security group
-func (p *AWS) CreateSG(ctx *lepton.Context, svc *ec2.EC2, imgName string, vpcID string) (sg *ec2.SecurityGroup, err error) {
-	t := time.Now().UnixNano()
-	s := strconv.FormatInt(t, 10)
+// validateCIDRBlock checks that cidr is a syntactically valid CIDR block (rejecting things like
+// "999.999.999.999/99") whose address family matches wantIPv4, the way Terraform's aws_security_group_rule does.
+func validateCIDRBlock(cidr string, wantIPv4 bool) error {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR block %q: %v", cidr, err)
+	}
 
-	sgName := imgName + s
+	if ip.To4() != nil != wantIPv4 {
+		return fmt.Errorf("invalid CIDR block %q: wrong IP address family", cidr)
+	}
 
-	createRes, err := svc.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
-		GroupName:   aws.String(sgName),
-		Description: aws.String("security group for " + imgName),
-		VpcId:       aws.String(vpcID),
-	})
+	if ip.String() != ipNet.IP.String() {
+		return fmt.Errorf("invalid CIDR block %q: host bits set, expected network address %s", cidr, ipNet.String())
+	}
+
+	return nil
+}
+
+// validateFirewallRule checks that a single FirewallRule has a well formed
+// direction, protocol, port range and at least one resolvable peer (CIDR,
+// IPv6 CIDR, prefix list or security group).
+func validateFirewallRule(rule types.FirewallRule) error {
+	switch rule.Direction {
+	case types.FirewallDirectionIngress, types.FirewallDirectionEgress:
+	default:
+		return fmt.Errorf("firewall rule: invalid direction %q, must be 'ingress' or 'egress'", rule.Direction)
+	}
+
+	switch rule.Protocol {
+	case "tcp", "udp", "icmp", "all", "-1":
+	default:
+		return fmt.Errorf("firewall rule: invalid protocol %q", rule.Protocol)
+	}
+
+	if rule.Protocol != "all" && rule.Protocol != "-1" && rule.Protocol != "icmp" {
+		if rule.Port == "" {
+			return errors.New("firewall rule: port or port range is required")
+		}
+
+		fromPort, toPort, err := parsePortRange(rule.Port)
+		if err != nil {
+			return fmt.Errorf("firewall rule: %s", err.Error())
+		} else if fromPort > toPort {
+			return fmt.Errorf("firewall rule: invalid port range %q, from-port is greater than to-port", rule.Port)
+		}
+	}
+
+	for _, cidr := range rule.CIDRBlocks {
+		if err := validateCIDRBlock(cidr, true); err != nil {
+			return fmt.Errorf("firewall rule: %s", err.Error())
+		}
+	}
+
+	for _, cidr := range rule.IPv6CIDRBlocks {
+		if err := validateCIDRBlock(cidr, false); err != nil {
+			return fmt.Errorf("firewall rule: %s", err.Error())
+		}
+	}
+
+	if len(rule.CIDRBlocks) == 0 && len(rule.IPv6CIDRBlocks) == 0 && len(rule.PrefixListIDs) == 0 && rule.SourceSecurityGroupID == "" {
+		return errors.New("firewall rule: at least one of CIDRBlocks, IPv6CIDRBlocks, PrefixListIDs or SourceSecurityGroupID is required")
+	}
+
+	return nil
+}
+
+// validateFirewallRules validates every rule individually and then rejects
+// rules in the same direction that overlap on protocol and port range while
+// sharing a peer (CIDR, prefix list or security group), mirroring the checks
+// Terraform's aws_security_group_rule performs at plan time.
+func validateFirewallRules(rules []types.FirewallRule) error {
+	for i, rule := range rules {
+		if err := validateFirewallRule(rule); err != nil {
+			return err
+		}
+
+		for j := i + 1; j < len(rules); j++ {
+			other := rules[j]
+			if rule.Direction != other.Direction || rule.Protocol != other.Protocol {
+				continue
+			}
+
+			if !portRangesOverlap(rule.Port, other.Port) {
+				continue
+			}
+
+			if peersOverlap(rule, other) {
+				return fmt.Errorf("firewall rule: duplicate or overlapping %s rule for protocol %q, ports %q and %q",
+					rule.Direction, rule.Protocol, rule.Port, other.Port)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parsePortRange(port string) (fromPort int, toPort int, err error) {
+	fromStr := port
+	toStr := port
+
+	if strings.Contains(port, "-") {
+		parts := strings.SplitN(port, "-", 2)
+		fromStr, toStr = parts[0], parts[1]
+	}
+
+	fromPort, err = strconv.Atoi(fromStr)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case "InvalidVpcID.NotFound":
-				errstr := fmt.Sprintf("Unable to find VPC with ID %q.", vpcID)
-				err = errors.New(errstr)
-				return
-			case "InvalidGroup.Duplicate":
-				errstr := fmt.Sprintf("Security group %q already exists.", imgName)
-				err = errors.New(errstr)
-				return
+		return 0, 0, fmt.Errorf("invalid port %q", fromStr)
+	}
+
+	toPort, err = strconv.Atoi(toStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", toStr)
+	}
+
+	return fromPort, toPort, nil
+}
+
+func portRangesOverlap(a, b string) bool {
+	aFrom, aTo, aErr := parsePortRange(a)
+	bFrom, bTo, bErr := parsePortRange(b)
+	if aErr != nil || bErr != nil {
+		return false
+	}
+
+	return aFrom <= bTo && bFrom <= aTo
+}
+
+func peersOverlap(a, b types.FirewallRule) bool {
+	if a.SourceSecurityGroupID != "" && a.SourceSecurityGroupID == b.SourceSecurityGroupID {
+		return true
+	}
+
+	for _, aCidr := range a.CIDRBlocks {
+		for _, bCidr := range b.CIDRBlocks {
+			if cidrBlocksOverlap(aCidr, bCidr) {
+				return true
 			}
 		}
-		errstr := fmt.Sprintf("Unable to create security group %q, %v", imgName, err)
-		err = errors.New(errstr)
+	}
+
+	for _, aCidr := range a.IPv6CIDRBlocks {
+		for _, bCidr := range b.IPv6CIDRBlocks {
+			if cidrBlocksOverlap(aCidr, bCidr) {
+				return true
+			}
+		}
+	}
+
+	for _, id := range a.PrefixListIDs {
+		if containsString(b.PrefixListIDs, id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildIPPermission translates a structured types.FirewallRule into the
+// ec2.IpPermission AWS expects, populating IPv4 ranges, IPv6 ranges, prefix
+// list IDs and SG-to-SG references as applicable.
+func buildIPPermission(rule types.FirewallRule) *ec2.IpPermission {
+	ec2Permission := new(ec2.IpPermission)
+
+	protocol := rule.Protocol
+	if protocol == "all" {
+		protocol = "-1"
+	}
+	ec2Permission.SetIpProtocol(protocol)
+
+	if protocol != "-1" && protocol != "icmp" {
+		fromPort, toPort, _ := parsePortRange(rule.Port)
+		ec2Permission.SetFromPort(int64(fromPort))
+		ec2Permission.SetToPort(int64(toPort))
+	}
+
+	for _, cidr := range rule.CIDRBlocks {
+		ec2Permission.IpRanges = append(ec2Permission.IpRanges, &ec2.IpRange{CidrIp: aws.String(cidr)})
+	}
+
+	for _, cidr := range rule.IPv6CIDRBlocks {
+		ec2Permission.Ipv6Ranges = append(ec2Permission.Ipv6Ranges, &ec2.Ipv6Range{CidrIpv6: aws.String(cidr)})
+	}
+
+	for _, prefixListID := range rule.PrefixListIDs {
+		ec2Permission.PrefixListIds = append(ec2Permission.PrefixListIds, &ec2.PrefixListId{PrefixListId: aws.String(prefixListID)})
+	}
+
+	if rule.SourceSecurityGroupID != "" {
+		ec2Permission.UserIdGroupPairs = append(ec2Permission.UserIdGroupPairs, &ec2.UserIdGroupPair{GroupId: aws.String(rule.SourceSecurityGroupID)})
+	}
+
+	return ec2Permission
+}
+
+// sgNameRegexp matches the characters EC2 allows in a security group name.
+var sgNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9 ._\-:/()#,@\[\]+=&;{}!$*]+$`)
+
+// validateSGName checks name against the same constraints EC2 itself enforces on a security group name, so
+// that a misconfigured name fails at plan time instead of after the CreateSecurityGroup call.
+func validateSGName(name string) error {
+	if len(name) == 0 || len(name) > 255 {
+		return fmt.Errorf("security group name %q must be between 1 and 255 characters", name)
+	}
+
+	if strings.HasPrefix(name, "sg-") {
+		return fmt.Errorf("security group name %q must not start with 'sg-'", name)
+	}
+
+	if !sgNameRegexp.MatchString(name) {
+		return fmt.Errorf("security group name %q contains characters not allowed by AWS", name)
+	}
+
+	return nil
+}
+
+// buildSGName derives a deterministic security group name from the image name and VPC alone (not the rule set),
+// so the same image/VPC pair always resolves to the same group and CreateSG can reconcile its rules in place
+// instead of orphaning it and minting a new group whenever the desired rules drift.
+func buildSGName(imgName string, vpcID string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s", imgName, vpcID)
+
+	return fmt.Sprintf("%s-%s", imgName, hex.EncodeToString(h.Sum(nil))[:12])
+}
+
+// buildSGPermissions translates the configured firewall rules (or, if none are set, the legacy RunConfig
+// Ports/UDPPorts) into the ingress/egress permissions a security group should have.
+func (p *AWS) buildSGPermissions(ctx *lepton.Context) (ingress []*ec2.IpPermission, egress []*ec2.IpPermission, err error) {
+	firewallRules := ctx.Config().CloudConfig.FirewallRules
+	if err = validateFirewallRules(firewallRules); err != nil {
 		return
 	}
-	fmt.Printf("Created security group %s with VPC %s.\n",
-		aws.StringValue(createRes.GroupId), vpcID)
 
-	var ec2Permissions []*ec2.IpPermission
+	if len(firewallRules) != 0 {
+		for _, rule := range firewallRules {
+			permission := buildIPPermission(rule)
+
+			if rule.Direction == types.FirewallDirectionEgress {
+				egress = append(egress, permission)
+			} else {
+				ingress = append(ingress, permission)
+			}
+		}
+
+		return
+	}
 
+	// legacy path: open the RunConfig ports to the world when no structured firewall rules were supplied
 	for _, port := range ctx.Config().RunConfig.Ports {
-		rule := p.buildFirewallRule("tcp", port)
-		ec2Permissions = append(ec2Permissions, rule)
+		ingress = append(ingress, p.buildFirewallRule("tcp", port))
 	}
 
 	for _, port := range ctx.Config().RunConfig.UDPPorts {
-		rule := p.buildFirewallRule("udp", port)
-		ec2Permissions = append(ec2Permissions, rule)
+		ingress = append(ingress, p.buildFirewallRule("udp", port))
 	}
 
-	// maybe have these ports specified from config.json in near future
-	if len(ec2Permissions) != 0 {
-		_, err = svc.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
-			GroupId:       createRes.GroupId,
-			IpPermissions: ec2Permissions,
+	return
+}
+
+// ipPermissionKey renders an ec2.IpPermission into a comparable string so reconcileSecurityGroupRules can diff
+// the desired and existing rule sets without caring about field ordering.
+func ipPermissionKey(permission *ec2.IpPermission) string {
+	var parts []string
+
+	parts = append(parts, aws.StringValue(permission.IpProtocol))
+	parts = append(parts, fmt.Sprintf("%d-%d", aws.Int64Value(permission.FromPort), aws.Int64Value(permission.ToPort)))
+
+	var peers []string
+	for _, r := range permission.IpRanges {
+		peers = append(peers, aws.StringValue(r.CidrIp))
+	}
+	for _, r := range permission.Ipv6Ranges {
+		peers = append(peers, aws.StringValue(r.CidrIpv6))
+	}
+	for _, r := range permission.PrefixListIds {
+		peers = append(peers, aws.StringValue(r.PrefixListId))
+	}
+	for _, r := range permission.UserIdGroupPairs {
+		peers = append(peers, aws.StringValue(r.GroupId))
+	}
+	sort.Strings(peers)
+
+	parts = append(parts, strings.Join(peers, ","))
+
+	return strings.Join(parts, "|")
+}
+
+// reconcileSecurityGroupRules authorizes any of the desired permissions the group is missing and revokes any of
+// the group's current permissions that are no longer desired, for a single direction (ingress or egress).
+func reconcileSecurityGroupRules(svc *ec2.EC2, groupID *string, desired []*ec2.IpPermission, existing []*ec2.IpPermission, egress bool) error {
+	existingByKey := map[string]*ec2.IpPermission{}
+	for _, permission := range existing {
+		existingByKey[ipPermissionKey(permission)] = permission
+	}
+
+	desiredByKey := map[string]*ec2.IpPermission{}
+	for _, permission := range desired {
+		desiredByKey[ipPermissionKey(permission)] = permission
+	}
+
+	var toAdd []*ec2.IpPermission
+	for key, permission := range desiredByKey {
+		if _, ok := existingByKey[key]; !ok {
+			toAdd = append(toAdd, permission)
+		}
+	}
+
+	var toRevoke []*ec2.IpPermission
+	for key, permission := range existingByKey {
+		if _, ok := desiredByKey[key]; !ok {
+			toRevoke = append(toRevoke, permission)
+		}
+	}
+
+	if len(toRevoke) != 0 {
+		if egress {
+			if _, err := svc.RevokeSecurityGroupEgress(&ec2.RevokeSecurityGroupEgressInput{GroupId: groupID, IpPermissions: toRevoke}); err != nil {
+				return fmt.Errorf("unable to revoke stale security group egress rules, %v", err)
+			}
+		} else {
+			if _, err := svc.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{GroupId: groupID, IpPermissions: toRevoke}); err != nil {
+				return fmt.Errorf("unable to revoke stale security group ingress rules, %v", err)
+			}
+		}
+	}
+
+	if len(toAdd) != 0 {
+		if egress {
+			if _, err := svc.AuthorizeSecurityGroupEgress(&ec2.AuthorizeSecurityGroupEgressInput{GroupId: groupID, IpPermissions: toAdd}); err != nil {
+				return fmt.Errorf("unable to authorize security group egress rules, %v", err)
+			}
+		} else {
+			if _, err := svc.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{GroupId: groupID, IpPermissions: toAdd}); err != nil {
+				return fmt.Errorf("unable to authorize security group ingress rules, %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateSG creates a security group, or adopts a matching one that already exists. The group name is derived
+// deterministically from imgName and vpcID alone, so repeated calls for the same image/VPC are idempotent:
+// instead of failing on InvalidGroup.Duplicate, the existing group is reconciled to have exactly the desired
+// ingress rules (adding missing ones, revoking stale ones). Egress rules are reconciled the same way only when
+// explicit egress rules are configured; otherwise the group's current egress rules are left as they are.
+func (p *AWS) CreateSG(ctx *lepton.Context, svc *ec2.EC2, imgName string, vpcID string) (sg *ec2.SecurityGroup, err error) {
+	sgName := buildSGName(imgName, vpcID)
+	if err = validateSGName(sgName); err != nil {
+		return
+	}
+
+	ingressPermissions, egressPermissions, err := p.buildSGPermissions(ctx)
+	if err != nil {
+		return
+	}
+
+	existingResult, err := svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("group-name"), Values: aws.StringSlice([]string{sgName})},
+			{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{vpcID})},
+		},
+	})
+	if err != nil {
+		err = fmt.Errorf("unable to describe security groups, %v", err)
+		return
+	}
+
+	var groupID *string
+
+	if len(existingResult.SecurityGroups) != 0 {
+		existing := existingResult.SecurityGroups[0]
+		groupID = existing.GroupId
+
+		fmt.Printf("Adopting existing security group %s with VPC %s.\n", aws.StringValue(groupID), vpcID)
+
+		if err = reconcileSecurityGroupRules(svc, groupID, ingressPermissions, existing.IpPermissions, false); err != nil {
+			return
+		}
+
+		if len(egressPermissions) != 0 {
+			// Only reconcile egress when the user configured explicit egress rules: otherwise
+			// egressPermissions is empty, and reconciling against that would read AWS's default
+			// allow-all egress rule as stale and revoke it, silently cutting all outbound traffic.
+			if err = reconcileSecurityGroupRules(svc, groupID, egressPermissions, existing.IpPermissionsEgress, true); err != nil {
+				return
+			}
+		}
+	} else {
+		var createRes *ec2.CreateSecurityGroupOutput
+		createRes, err = svc.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+			GroupName:   aws.String(sgName),
+			Description: aws.String("security group for " + imgName),
+			VpcId:       aws.String(vpcID),
 		})
 		if err != nil {
-			errstr := fmt.Sprintf("Unable to set security group %q ingress, %v", imgName, err)
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case "InvalidVpcID.NotFound":
+					errstr := fmt.Sprintf("Unable to find VPC with ID %q.", vpcID)
+					err = errors.New(errstr)
+					return
+				case "InvalidGroup.Duplicate":
+					errstr := fmt.Sprintf("Security group %q already exists.", sgName)
+					err = errors.New(errstr)
+					return
+				}
+			}
+			errstr := fmt.Sprintf("Unable to create security group %q, %v", sgName, err)
 			err = errors.New(errstr)
 			return
 		}
+		fmt.Printf("Created security group %s with VPC %s.\n",
+			aws.StringValue(createRes.GroupId), vpcID)
+
+		groupID = createRes.GroupId
+
+		if err = reconcileSecurityGroupRules(svc, groupID, ingressPermissions, nil, false); err != nil {
+			return
+		}
+
+		if len(egressPermissions) != 0 {
+			// AWS creates a default "allow all" egress rule with every new security group; revoke it before
+			// authorizing the explicit egress rules the user asked for so the group ends up locked down rather
+			// than additionally open.
+			if _, err = svc.RevokeSecurityGroupEgress(&ec2.RevokeSecurityGroupEgressInput{
+				GroupId: groupID,
+				IpPermissions: []*ec2.IpPermission{
+					{
+						IpProtocol: aws.String("-1"),
+						IpRanges:   []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+					},
+				},
+			}); err != nil {
+				errstr := fmt.Sprintf("Unable to revoke default security group %q egress, %v", sgName, err)
+				err = errors.New(errstr)
+				return
+			}
+
+			if err = reconcileSecurityGroupRules(svc, groupID, egressPermissions, nil, true); err != nil {
+				return
+			}
+		}
 	}
 
 	result, err := svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
-		GroupIds: aws.StringSlice([]string{*createRes.GroupId}),
+		GroupIds: aws.StringSlice([]string{*groupID}),
 	})
 	if err != nil {
 		return
 	} else if len(result.SecurityGroups) == 0 {
 		err = errors.New("failed creating security group")
+		return
 	}
 
 	sg = result.SecurityGroups[0]
@@ -294,9 +875,78 @@ func (p *AWS) CreateSG(ctx *lepton.Context, svc *ec2.EC2, imgName string, vpcID
 	return
 }
 
-// CreateVPC creates a virtual network
-func (p *AWS) CreateVPC(ctx *lepton.Context, svc *ec2.EC2) (vpc *ec2.Vpc, err error) {
-	vnetName := ctx.Config().CloudConfig.VPC
+const defaultSubnetPrefixLen = 24
+
+// subdivideCidrBlock splits cidr into the non-overlapping /newPrefixLen blocks it contains.
+func subdivideCidrBlock(cidr string, newPrefixLen int) ([]string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR block %q: %v", cidr, err)
+	}
+
+	baseLen, bits := ipNet.Mask.Size()
+	if newPrefixLen <= baseLen || newPrefixLen > bits {
+		return nil, fmt.Errorf("subnet prefix length /%d does not fit inside %q", newPrefixLen, cidr)
+	}
+
+	blockCount := 1 << uint(newPrefixLen-baseLen)
+	blockSize := uint32(1) << uint(32-newPrefixLen)
+	base := binary.BigEndian.Uint32(ipNet.IP.To4())
+
+	blocks := make([]string, 0, blockCount)
+	for i := 0; i < blockCount; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(i)*blockSize)
+		blocks = append(blocks, fmt.Sprintf("%s/%d", ip.String(), newPrefixLen))
+	}
+
+	return blocks, nil
+}
+
+// cidrBlocksOverlap reports whether two CIDR blocks (IPv4 or IPv6) share any address.
+func cidrBlocksOverlap(a, b string) bool {
+	_, aNet, aErr := net.ParseCIDR(a)
+	_, bNet, bErr := net.ParseCIDR(b)
+	if aErr != nil || bErr != nil {
+		return false
+	}
+
+	return aNet.Contains(bNet.IP) || bNet.Contains(aNet.IP)
+}
+
+// subdivideIpv6CidrBlock carves consecutive /64 blocks out of an IPv6 VPC allocation (which AWS always hands out
+// as a /56), one per entry in index order.
+func subdivideIpv6CidrBlock(cidr string, index int) (string, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid IPv6 CIDR block %q: %v", cidr, err)
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return "", fmt.Errorf("invalid IPv6 address in %q", cidr)
+	}
+
+	subnet := make(net.IP, 16)
+	copy(subnet, ip16)
+	subnet[7] = byte(index)
+
+	baseLen, _ := ipNet.Mask.Size()
+	if baseLen > 64 {
+		return "", fmt.Errorf("CIDR block %q is narrower than /64", cidr)
+	}
+
+	return fmt.Sprintf("%s/64", subnet.String()), nil
+}
+
+// CreateVPC creates a virtual network, subdividing it into one subnet per availability zone in the region so that
+// instances can be spread across AZs. Subnet size defaults to /24 and can be overridden with CloudConfig.SubnetCIDR
+// (a prefix length such as "/26"). When tagSubnetRoles is true, each created subnet is tagged
+// kubernetes.io/role/elb or kubernetes.io/role/internal-elb based on whether isPublicSubnet classifies it as
+// public or private.
+func (p *AWS) CreateVPC(ctx *lepton.Context, svc *ec2.EC2, tagSubnetRoles bool) (vpc *ec2.Vpc, subnets []*ec2.Subnet, err error) {
+	cloudConfig := ctx.Config().CloudConfig
+	vnetName := cloudConfig.VPC
 
 	if vnetName == "" {
 		err = errors.New("specify vpc name")
@@ -323,7 +973,8 @@ func (p *AWS) CreateVPC(ctx *lepton.Context, svc *ec2.EC2) (vpc *ec2.Vpc, err er
 		},
 	}
 
-	if ctx.Config().CloudConfig.EnableIPv6 {
+	enableIPv6 := cloudConfig.EnableIPv6
+	if enableIPv6 {
 		createInput.SetAmazonProvidedIpv6CidrBlock(true)
 	}
 
@@ -341,17 +992,116 @@ func (p *AWS) CreateVPC(ctx *lepton.Context, svc *ec2.EC2) (vpc *ec2.Vpc, err er
 	}
 
 	vpc, err = p.GetVPC(ctx, svc)
+	if err != nil {
+		return
+	}
+
+	subnetPrefixLen := defaultSubnetPrefixLen
+	if cloudConfig.SubnetCIDR != "" {
+		subnetPrefixLen, err = strconv.Atoi(strings.TrimPrefix(cloudConfig.SubnetCIDR, "/"))
+		if err != nil {
+			err = fmt.Errorf("invalid CloudConfig.SubnetCIDR %q: %v", cloudConfig.SubnetCIDR, err)
+			return
+		}
+	}
+
+	candidateBlocks, err := subdivideCidrBlock(*vpc.CidrBlock, subnetPrefixLen)
+	if err != nil {
+		return
+	}
+
+	azsResult, err := svc.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		err = fmt.Errorf("unable to describe availability zones, %v", err)
+		return
+	}
+
+	existing, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{*vpc.VpcId})},
+		},
+	})
+	if err != nil {
+		err = fmt.Errorf("unable to describe subnets, %v", err)
+		return
+	}
+
+	usedBlocks := []string{}
+	for _, s := range existing.Subnets {
+		usedBlocks = append(usedBlocks, *s.CidrBlock)
+	}
+
+	tags, _ = buildAwsTags([]types.Tag{}, cloudConfig.Subnet)
+
+	blockIndex := 0
+	for _, az := range azsResult.AvailabilityZones {
+		var block string
+		for blockIndex < len(candidateBlocks) {
+			candidate := candidateBlocks[blockIndex]
+			blockIndex++
+
+			overlaps := false
+			for _, used := range usedBlocks {
+				if cidrBlocksOverlap(candidate, used) {
+					overlaps = true
+					break
+				}
+			}
+
+			if !overlaps {
+				block = candidate
+				break
+			}
+		}
 
-	if err == nil {
-		tags, _ = buildAwsTags([]types.Tag{}, ctx.Config().CloudConfig.Subnet)
+		if block == "" {
+			break
+		}
 
-		_, err = svc.CreateSubnet(&ec2.CreateSubnetInput{
-			VpcId:     vpc.VpcId,
-			CidrBlock: vpc.CidrBlock,
+		subnetInput := &ec2.CreateSubnetInput{
+			VpcId:            vpc.VpcId,
+			CidrBlock:        aws.String(block),
+			AvailabilityZone: az.ZoneName,
 			TagSpecifications: []*ec2.TagSpecification{
 				{Tags: tags, ResourceType: aws.String("subnet")},
 			},
-		})
+		}
+
+		if enableIPv6 && len(vpc.Ipv6CidrBlockAssociationSet) != 0 {
+			var ipv6Block string
+			ipv6Block, err = subdivideIpv6CidrBlock(*vpc.Ipv6CidrBlockAssociationSet[0].Ipv6CidrBlock, len(subnets))
+			if err != nil {
+				err = fmt.Errorf("unable to allocate IPv6 CIDR block for subnet in %s: %v", *az.ZoneName, err)
+				return
+			}
+
+			subnetInput.Ipv6CidrBlock = aws.String(ipv6Block)
+		}
+
+		createRes, createErr := svc.CreateSubnet(subnetInput)
+		if createErr != nil {
+			err = createErr
+			return
+		}
+
+		if tagSubnetRoles {
+			role := "internal-elb"
+			if isPublic, classifyErr := p.isPublicSubnet(svc, createRes.Subnet); classifyErr == nil && isPublic {
+				role = "elb"
+			}
+
+			_, err = svc.CreateTags(&ec2.CreateTagsInput{
+				Resources: []*string{createRes.Subnet.SubnetId},
+				Tags:      []*ec2.Tag{{Key: aws.String("kubernetes.io/role/" + role), Value: aws.String("1")}},
+			})
+			if err != nil {
+				err = fmt.Errorf("unable to tag subnet '%s', %v", *createRes.Subnet.SubnetId, err)
+				return
+			}
+		}
+
+		usedBlocks = append(usedBlocks, block)
+		subnets = append(subnets, createRes.Subnet)
 	}
 
 	return
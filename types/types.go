@@ -0,0 +1,60 @@
+package types
+
+// Tag represents a cloud resource tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// FirewallDirection identifies whether a FirewallRule applies to inbound or outbound traffic.
+type FirewallDirection string
+
+const (
+	// FirewallDirectionIngress marks a rule as applying to inbound traffic.
+	FirewallDirectionIngress FirewallDirection = "ingress"
+	// FirewallDirectionEgress marks a rule as applying to outbound traffic.
+	FirewallDirectionEgress FirewallDirection = "egress"
+)
+
+// FirewallRule describes a single structured firewall rule: a direction, protocol, port or port range, and one or
+// more peers (CIDR blocks, prefix lists or a referenced security group).
+type FirewallRule struct {
+	Direction             FirewallDirection
+	Protocol              string
+	Port                  string
+	CIDRBlocks            []string
+	IPv6CIDRBlocks        []string
+	PrefixListIDs         []string
+	SourceSecurityGroupID string
+}
+
+// RunConfig holds the configuration used to run an instance.
+type RunConfig struct {
+	Ports    []string
+	UDPPorts []string
+}
+
+// CloudConfig holds cloud-provider configuration for a deployment.
+type CloudConfig struct {
+	VPC           string
+	Subnet        string
+	SecurityGroup string
+	EnableIPv6    bool
+	FirewallRules []FirewallRule
+
+	// VPCID, SubnetIDs, ControlPlaneSecurityGroupID and WorkerSecurityGroupID let a deployment adopt pre-existing
+	// network resources instead of creating new ones. When set, the referenced resources are validated and reused
+	// as-is rather than looked up by name/tag.
+	VPCID                       string
+	SubnetIDs                   []string
+	ControlPlaneSecurityGroupID string
+	WorkerSecurityGroupID       string
+
+	// AvailabilityZone pins subnet selection and instance placement to a single AZ. When unset, GetSubnet returns
+	// every matching subnet and callers pick the default-for-AZ subnet among them, round-robining across them
+	// only when none is default-for-AZ.
+	AvailabilityZone string
+
+	// SubnetCIDR sizes the per-AZ subnets CreateVPC carves out of the VPC CIDR, e.g. "/26". Defaults to /24.
+	SubnetCIDR string
+}